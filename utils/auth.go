@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//Auth is implemented by pluggable backends that can validate a username/password
+//pair presented via HTTP Basic or Proxy-Authorization, SOCKS5 user/pass auth, etc.
+type Auth interface {
+	Validate(user, pass string) bool
+}
+
+//StaticAuth is an in-memory Auth backed by a fixed set of user:pass entries,
+//useful for credentials supplied directly on the command line.
+type StaticAuth struct {
+	data ConcurrentMap
+}
+
+//NewStaticAuth builds a StaticAuth from a list of "user:pass" strings.
+func NewStaticAuth(userpassArr []string) (auth *StaticAuth) {
+	auth = &StaticAuth{
+		data: NewConcurrentMap(),
+	}
+	auth.Add(userpassArr)
+	return
+}
+
+//Add adds more "user:pass" entries, returning the number successfully parsed.
+func (auth *StaticAuth) Add(userpassArr []string) (n int) {
+	for _, userpass := range userpassArr {
+		u := strings.Split(userpass, ":")
+		if len(u) == 2 {
+			auth.data.Set(u[0], u[1])
+			n++
+		}
+	}
+	return
+}
+
+//Validate implements Auth using a constant-time comparison against the stored password.
+func (auth *StaticAuth) Validate(user, pass string) bool {
+	p, ok := auth.data.Get(user)
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(p.(string)), []byte(pass)) == 1
+}
+
+//Total returns the number of entries currently loaded.
+func (auth *StaticAuth) Total() (n int) {
+	n = auth.data.Count()
+	return
+}
+
+//BasicAuth is a file-backed Auth. Entries are "user:pass" lines where pass
+//may be a plaintext value or a bcrypt hash (detected by the "$2a$"/"$2b$"/"$2y$" prefix),
+//so operators can migrate existing flat files to hashed credentials in place.
+type BasicAuth struct {
+	data ConcurrentMap
+}
+
+//NewBasicAuth creates an empty BasicAuth; use AddFromFile or Add to populate it.
+func NewBasicAuth() (auth *BasicAuth) {
+	auth = &BasicAuth{
+		data: NewConcurrentMap(),
+	}
+	return
+}
+
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+//AddFromFile loads "user:pass" entries from file, one per line, returning the count added.
+func (auth *BasicAuth) AddFromFile(file string) (n int, err error) {
+	_content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	userpassArr := strings.Split(strings.Replace(string(_content), "\r", "", -1), "\n")
+	n = auth.Add(userpassArr)
+	return
+}
+
+//Add adds more "user:pass" entries, returning the number successfully parsed.
+func (auth *BasicAuth) Add(userpassArr []string) (n int) {
+	for _, userpass := range userpassArr {
+		if strings.HasPrefix(userpass, "#") {
+			continue
+		}
+		u := strings.Split(strings.Trim(userpass, " "), ":")
+		if len(u) == 2 {
+			auth.data.Set(u[0], u[1])
+			n++
+		}
+	}
+	return
+}
+
+//Validate implements Auth, comparing bcrypt hashes with bcrypt.CompareHashAndPassword
+//and plaintext entries with a constant-time comparison.
+func (auth *BasicAuth) Validate(user, pass string) bool {
+	v, ok := auth.data.Get(user)
+	if !ok {
+		return false
+	}
+	stored := v.(string)
+	if isBcryptHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) == 1
+}
+
+//Total returns the number of entries currently loaded.
+func (auth *BasicAuth) Total() (n int) {
+	n = auth.data.Count()
+	return
+}
+
+//CheckUserPass is a compatibility alias for Validate, kept for callers written
+//against BasicAuth before it gained the Auth interface.
+func (auth *BasicAuth) CheckUserPass(user, pass string) (ok bool) {
+	return auth.Validate(user, pass)
+}
+
+//Check is a compatibility alias that validates a "user:pass" string, kept for
+//callers written against BasicAuth before it gained the Auth interface.
+func (auth *BasicAuth) Check(userpass string) (ok bool) {
+	u := strings.Split(strings.Trim(userpass, " "), ":")
+	if len(u) == 2 {
+		return auth.Validate(u[0], u[1])
+	}
+	return
+}
+
+//HTTPAuth delegates credential checks to an external HTTP service, POSTing the
+//username/password and treating any 2xx response as success.
+type HTTPAuth struct {
+	URL     string
+	Timeout time.Duration
+	client  *http.Client
+}
+
+//NewHTTPAuth builds an HTTPAuth that POSTs to url with the given timeout.
+func NewHTTPAuth(url string, timeout time.Duration) (auth *HTTPAuth) {
+	auth = &HTTPAuth{
+		URL:     url,
+		Timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+	}
+	return
+}
+
+//Validate implements Auth by POSTing username/password to the configured URL.
+func (auth *HTTPAuth) Validate(user, pass string) bool {
+	form := url.Values{}
+	form.Set("username", user)
+	form.Set("password", pass)
+	resp, err := auth.client.Post(auth.URL, "application/x-www-form-urlencoded", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
@@ -0,0 +1,73 @@
+package utils
+
+import "testing"
+
+func TestIsBcryptHash(t *testing.T) {
+	cases := []struct {
+		in   string
+		want bool
+	}{
+		{"$2a$10$abcdefghijklmnopqrstuv", true},
+		{"$2b$12$abcdefghijklmnopqrstuv", true},
+		{"$2y$10$abcdefghijklmnopqrstuv", true},
+		{"plaintextpass", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := isBcryptHash(c.in); got != c.want {
+			t.Errorf("isBcryptHash(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestBasicAuthAddSkipsComments(t *testing.T) {
+	auth := NewBasicAuth()
+	n := auth.Add([]string{"# comment:x", "user1:pass1", "  ", "#user2:pass2"})
+	if n != 1 {
+		t.Fatalf("Add() = %d, want 1", n)
+	}
+	if !auth.Validate("user1", "pass1") {
+		t.Errorf("user1 should validate")
+	}
+	if auth.Validate("# comment", "x") {
+		t.Errorf("comment line should not have been loaded as a credential")
+	}
+}
+
+func TestBasicAuthValidateBcryptAndPlaintext(t *testing.T) {
+	auth := NewBasicAuth()
+	// bcrypt hash of "secret"
+	auth.Add([]string{"hashed:$2b$04$qD4rxZLqdCwUceJ6XuVVBuQCPn8Gj89mUdDmM7HQhdh4/IcrwPzhG"})
+	auth.Add([]string{"plain:secret"})
+
+	if !auth.Validate("hashed", "secret") {
+		t.Errorf("bcrypt entry should validate against its plaintext password")
+	}
+	if auth.Validate("hashed", "wrong") {
+		t.Errorf("bcrypt entry should reject a wrong password")
+	}
+	if !auth.Validate("plain", "secret") {
+		t.Errorf("plaintext entry should validate")
+	}
+	if auth.Validate("missing", "secret") {
+		t.Errorf("unknown user should not validate")
+	}
+}
+
+func TestBasicAuthCheckCompat(t *testing.T) {
+	auth := NewBasicAuth()
+	auth.Add([]string{"user1:pass1"})
+
+	if !auth.CheckUserPass("user1", "pass1") {
+		t.Errorf("CheckUserPass should validate a known user")
+	}
+	if auth.CheckUserPass("user1", "wrong") {
+		t.Errorf("CheckUserPass should reject a wrong password")
+	}
+	if !auth.Check("user1:pass1") {
+		t.Errorf("Check should validate a known user:pass string")
+	}
+	if auth.Check("user1:wrong") {
+		t.Errorf("Check should reject a wrong user:pass string")
+	}
+}
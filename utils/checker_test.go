@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckerRecordEWMAAndBackoff(t *testing.T) {
+	c := &Checker{data: NewConcurrentMap()}
+	item := CheckerItem{Host: "example.com:80", Backoff: checkerMinBackoff}
+
+	for i := 0; i < 5; i++ {
+		c.record(item, true)
+		v, _ := c.data.Get(item.Host)
+		item = v.(CheckerItem)
+	}
+	if item.Score <= checkerHealthyScore {
+		t.Errorf("score after 5 successes = %v, want > %v", item.Score, checkerHealthyScore)
+	}
+	if item.Backoff <= checkerMinBackoff {
+		t.Errorf("backoff after repeated success = %v, want > min %v", item.Backoff, checkerMinBackoff)
+	}
+
+	item.Score = 1
+	item.Backoff = checkerMaxBackoff
+	c.data.Set(item.Host, item)
+	// A single failure isn't enough to drop the EWMA score below the healthy
+	// threshold, so it takes a couple of consecutive failures before backoff shrinks.
+	for i := 0; i < 2; i++ {
+		c.record(item, false)
+		v, _ := c.data.Get(item.Host)
+		item = v.(CheckerItem)
+	}
+	if item.Backoff >= checkerMaxBackoff {
+		t.Errorf("backoff after repeated failures = %v, want < max %v", item.Backoff, checkerMaxBackoff)
+	}
+	if item.NextCheck.Before(time.Now()) {
+		t.Errorf("NextCheck should be scheduled in the future")
+	}
+}
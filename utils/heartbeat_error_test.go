@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestSendErrorFrame(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	writer := HeartbeatReadWriter{conn: &a, l: &sync.Mutex{}}
+	reader := HeartbeatReadWriter{conn: &b}
+
+	done := make(chan error, 1)
+	go func() { done <- writer.SendError("boom") }()
+
+	typ, payload, err := reader.readFrame()
+	if err != nil {
+		t.Fatalf("readFrame() err = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("SendError() err = %v", err)
+	}
+	if typ != FrameError {
+		t.Errorf("typ = %v, want FrameError", typ)
+	}
+	if !bytes.Equal(payload, []byte("boom")) {
+		t.Errorf("payload = %q, want %q", payload, "boom")
+	}
+}
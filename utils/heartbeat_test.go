@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestHeartbeatFrameRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	writer := HeartbeatReadWriter{conn: &a, l: &sync.Mutex{}}
+	reader := HeartbeatReadWriter{conn: &b}
+
+	cases := []struct {
+		typ     FrameType
+		payload []byte
+	}{
+		{FrameHeartbeat, nil},
+		{FrameData, []byte("hello")},
+		{FramePing, nil},
+		{FrameClose, []byte("bye")},
+	}
+	for _, c := range cases {
+		done := make(chan error, 1)
+		go func(typ FrameType, payload []byte) {
+			done <- writer.writeFrame(typ, payload)
+		}(c.typ, c.payload)
+
+		gotTyp, gotPayload, err := reader.readFrame()
+		if err != nil {
+			t.Fatalf("readFrame() err = %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("writeFrame() err = %v", err)
+		}
+		if gotTyp != c.typ {
+			t.Errorf("typ = %v, want %v", gotTyp, c.typ)
+		}
+		if string(gotPayload) != string(c.payload) {
+			t.Errorf("payload = %q, want %q", gotPayload, c.payload)
+		}
+	}
+}
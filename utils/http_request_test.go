@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewHTTPRequestPipelining(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	req1Raw := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	req2Raw := "GET /second HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	go func() {
+		client.Write([]byte(req1Raw + req2Raw))
+	}()
+
+	var serverConn net.Conn = server
+	req, err := NewHTTPRequest(&serverConn, 4096, false, nil, nil)
+	if err != nil {
+		t.Fatalf("NewHTTPRequest() err = %v", err)
+	}
+	if string(req.HeadBuf) != req1Raw {
+		t.Errorf("HeadBuf = %q, want %q (must not include the next pipelined request)", req.HeadBuf, req1Raw)
+	}
+
+	req2, err := NewHTTPRequest(&serverConn, 4096, false, nil, req.ConnReader())
+	if err != nil {
+		t.Fatalf("second NewHTTPRequest() err = %v", err)
+	}
+	if string(req2.HeadBuf) != req2Raw {
+		t.Errorf("second HeadBuf = %q, want %q", req2.HeadBuf, req2Raw)
+	}
+}
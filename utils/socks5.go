@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks5Version byte = 0x05
+
+	socks5AuthNone         byte = 0x00
+	socks5AuthUserPass     byte = 0x02
+	socks5AuthNoAcceptable byte = 0xFF
+
+	socks5CmdConnect      byte = 0x01
+	socks5CmdUDPAssociate byte = 0x03
+
+	socks5AtypIPv4   byte = 0x01
+	socks5AtypDomain byte = 0x03
+	socks5AtypIPv6   byte = 0x04
+
+	//Socks5ReplySucceeded and Socks5ReplyGeneralFailure are the REP codes defined by
+	//RFC 1928 §6, for use with SOCKS5Request.Reply.
+	Socks5ReplySucceeded      byte = 0x00
+	Socks5ReplyGeneralFailure byte = 0x01
+)
+
+//SOCKS5Request decodes a SOCKS5 handshake (RFC 1928) plus optional username/password
+//auth (RFC 1929) off a net.Conn, returning the same {Host, Method, IsHTTPS} shape as
+//HTTPRequest so the existing dial/pool/checker plumbing (OutPool, ConnManager,
+//Checker.Add) works unchanged regardless of which front-end accepted the client.
+type SOCKS5Request struct {
+	conn   *net.Conn
+	Host   string
+	Method string
+}
+
+//NewSOCKS5Request negotiates method selection, performs user/pass auth against auth
+//when non-nil, and parses a CONNECT or UDP ASSOCIATE request (IPv4/IPv6/domain
+//address types).
+func NewSOCKS5Request(inConn *net.Conn, auth Auth) (req SOCKS5Request, err error) {
+	req = SOCKS5Request{conn: inConn}
+	if err = req.negotiateMethod(auth != nil); err != nil {
+		CloseConn(inConn)
+		return
+	}
+	if auth != nil {
+		if err = req.authenticate(auth); err != nil {
+			CloseConn(inConn)
+			return
+		}
+	}
+	if err = req.readRequest(); err != nil {
+		CloseConn(inConn)
+		return
+	}
+	return
+}
+
+func (req *SOCKS5Request) negotiateMethod(requireAuth bool) (err error) {
+	head := make([]byte, 2)
+	if _, err = io.ReadFull((*req.conn), head); err != nil {
+		return
+	}
+	if head[0] != socks5Version {
+		err = fmt.Errorf("socks5 decoder unsupported version:%d", head[0])
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err = io.ReadFull((*req.conn), methods); err != nil {
+		return
+	}
+	want := socks5AuthNone
+	if requireAuth {
+		want = socks5AuthUserPass
+	}
+	selected := socks5AuthNoAcceptable
+	for _, m := range methods {
+		if m == want {
+			selected = want
+			break
+		}
+	}
+	if _, err = (*req.conn).Write([]byte{socks5Version, selected}); err != nil {
+		return
+	}
+	if selected == socks5AuthNoAcceptable {
+		err = fmt.Errorf("socks5 decoder no acceptable auth method offered")
+	}
+	return
+}
+
+//authenticate implements the RFC 1929 username/password sub-negotiation.
+func (req *SOCKS5Request) authenticate(auth Auth) (err error) {
+	head := make([]byte, 2)
+	if _, err = io.ReadFull((*req.conn), head); err != nil {
+		return
+	}
+	uname := make([]byte, head[1])
+	if _, err = io.ReadFull((*req.conn), uname); err != nil {
+		return
+	}
+	plenBuf := make([]byte, 1)
+	if _, err = io.ReadFull((*req.conn), plenBuf); err != nil {
+		return
+	}
+	passwd := make([]byte, plenBuf[0])
+	if _, err = io.ReadFull((*req.conn), passwd); err != nil {
+		return
+	}
+	ok := auth.Validate(string(uname), string(passwd))
+	status := byte(0x00)
+	if !ok {
+		status = 0x01
+	}
+	if _, werr := (*req.conn).Write([]byte{0x01, status}); werr != nil {
+		err = werr
+		return
+	}
+	if !ok {
+		err = fmt.Errorf("socks5 auth fail")
+	}
+	return
+}
+
+func (req *SOCKS5Request) readRequest() (err error) {
+	head := make([]byte, 4)
+	if _, err = io.ReadFull((*req.conn), head); err != nil {
+		return
+	}
+	if head[0] != socks5Version {
+		err = fmt.Errorf("socks5 decoder unsupported version:%d", head[0])
+		return
+	}
+	switch head[1] {
+	case socks5CmdConnect:
+		req.Method = "CONNECT"
+	case socks5CmdUDPAssociate:
+		req.Method = "UDPASSOCIATE"
+	default:
+		err = fmt.Errorf("socks5 decoder unsupported command:%d", head[1])
+		return
+	}
+	var host string
+	switch head[3] {
+	case socks5AtypIPv4:
+		addr := make([]byte, 4)
+		if _, err = io.ReadFull((*req.conn), addr); err != nil {
+			return
+		}
+		host = net.IP(addr).String()
+	case socks5AtypIPv6:
+		addr := make([]byte, 16)
+		if _, err = io.ReadFull((*req.conn), addr); err != nil {
+			return
+		}
+		host = net.IP(addr).String()
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull((*req.conn), l); err != nil {
+			return
+		}
+		domain := make([]byte, l[0])
+		if _, err = io.ReadFull((*req.conn), domain); err != nil {
+			return
+		}
+		host = string(domain)
+	default:
+		err = fmt.Errorf("socks5 decoder unsupported address type:%d", head[3])
+		return
+	}
+	portBuf := make([]byte, 2)
+	if _, err = io.ReadFull((*req.conn), portBuf); err != nil {
+		return
+	}
+	req.Host = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBuf))))
+	return
+}
+
+//IsHTTPS reports whether this request is a CONNECT-style tunnel, matching
+//HTTPRequest.IsHTTPS so downstream code can treat both front-ends identically.
+func (req *SOCKS5Request) IsHTTPS() bool {
+	return req.Method == "CONNECT"
+}
+
+//Reply sends the SOCKS5 reply for this request (RFC 1928 §6) with the given REP
+//code, mirroring HTTPRequest.HTTPSReply's role of acknowledging the tunnel before
+//raw relaying begins.
+func (req *SOCKS5Request) Reply(rep byte) (err error) {
+	_, err = (*req.conn).Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return
+}
+
+//SniffListener wraps a net.Listener so each accepted conn's first byte can be
+//peeked without being consumed, letting Accept classify SOCKS5 (0x05) vs HTTP
+//traffic so a single port can serve both.
+type SniffListener struct {
+	net.Listener
+}
+
+//NewSniffListener wraps l for protocol sniffing.
+func NewSniffListener(l net.Listener) *SniffListener {
+	return &SniffListener{Listener: l}
+}
+
+//Accept returns the next connection along with whether its first byte identifies
+//it as SOCKS5; the returned conn still yields that byte to the first Read.
+func (l *SniffListener) Accept() (conn net.Conn, isSOCKS5 bool, err error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return
+	}
+	r := bufio.NewReader(c)
+	b, err := r.Peek(1)
+	if err != nil {
+		CloseConn(&c)
+		return
+	}
+	isSOCKS5 = b[0] == socks5Version
+	conn = &sniffConn{Conn: c, r: r}
+	return
+}
+
+//sniffConn reads through the bufio.Reader used to peek the first byte so that byte
+//isn't lost to whoever reads the conn next.
+type sniffConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestSOCKS5ReadRequestAddressTypes(t *testing.T) {
+	cases := []struct {
+		name     string
+		atyp     byte
+		addr     []byte
+		wantHost string
+	}{
+		{"ipv4", socks5AtypIPv4, net.ParseIP("93.184.216.34").To4(), "93.184.216.34:1080"},
+		{"ipv6", socks5AtypIPv6, net.ParseIP("2001:db8::1").To16(), "[2001:db8::1]:1080"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				payload := []byte{socks5Version, socks5CmdConnect, 0x00, c.atyp}
+				payload = append(payload, c.addr...)
+				portBuf := make([]byte, 2)
+				binary.BigEndian.PutUint16(portBuf, 1080)
+				payload = append(payload, portBuf...)
+				client.Write(payload)
+			}()
+
+			req := SOCKS5Request{conn: &server}
+			if err := req.readRequest(); err != nil {
+				t.Fatalf("readRequest() err = %v", err)
+			}
+			if req.Host != c.wantHost {
+				t.Errorf("Host = %q, want %q", req.Host, c.wantHost)
+			}
+			if req.Method != "CONNECT" {
+				t.Errorf("Method = %q, want CONNECT", req.Method)
+			}
+			if _, _, err := net.SplitHostPort(req.Host); err != nil {
+				t.Errorf("net.SplitHostPort(%q) err = %v", req.Host, err)
+			}
+		})
+	}
+}
+
+func TestSOCKS5ReadRequestDomain(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	domain := "example.com"
+	go func() {
+		payload := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypDomain, byte(len(domain))}
+		payload = append(payload, domain...)
+		portBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(portBuf, 443)
+		payload = append(payload, portBuf...)
+		client.Write(payload)
+	}()
+
+	req := SOCKS5Request{conn: &server}
+	if err := req.readRequest(); err != nil {
+		t.Fatalf("readRequest() err = %v", err)
+	}
+	if want := "example.com:443"; req.Host != want {
+		t.Errorf("Host = %q, want %q", req.Host, want)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/base64"
@@ -10,28 +11,66 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"net/url"
 	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	//checkerWorkers bounds how many probes can be in flight at once, regardless of
+	//how many hosts are tracked.
+	checkerWorkers = 20
+	//checkerRatePerSec caps how many probes the worker pool may start per second,
+	//via a token-bucket refilled at this rate.
+	checkerRatePerSec = 50
+	//checkerProbeBytes is the most response body a plain-HTTP probe will read before
+	//the connection is aborted, so a slow or huge response can't balloon memory.
+	checkerProbeBytes = 1024
+	//checkerMinBackoff/checkerMaxBackoff bound the adaptive recheck interval: hosts
+	//that keep succeeding are checked less often, flapping hosts more often.
+	checkerMinBackoff = 5 * time.Second
+	checkerMaxBackoff = 10 * time.Minute
+	//checkerEWMAAlpha weights how much each new probe outcome moves the score;
+	//higher reacts faster, lower smooths out one-off blips.
+	checkerEWMAAlpha = 0.3
+	//checkerHealthyScore is the EWMA threshold above which a host is considered reachable.
+	checkerHealthyScore = 0.5
+)
+
 type Checker struct {
 	data       ConcurrentMap
 	blockedMap ConcurrentMap
 	directMap  ConcurrentMap
 	interval   int64
 	timeout    int
+	tokens     chan struct{}
+	jobs       chan CheckerItem
 }
+
+//CheckerStats is a point-in-time snapshot of a host's health as tracked by Checker.
+type CheckerStats struct {
+	Score     float64
+	NextCheck time.Time
+	Backoff   time.Duration
+}
+
 type CheckerItem struct {
-	IsHTTPS      bool
-	Method       string
-	URL          string
-	Domain       string
-	Host         string
-	Data         []byte
-	SuccessCount uint
-	FailCount    uint
+	IsHTTPS bool
+	Method  string
+	URL     string
+	Domain  string
+	Host    string
+	Data    []byte
+	//Score is an exponentially-weighted moving average of recent probe outcomes,
+	//1 meaning consistently reachable and 0 meaning consistently failing.
+	Score float64
+	//NextCheck is the earliest time this host is eligible to be probed again.
+	NextCheck time.Time
+	//Backoff is the current recheck interval, doubled after each probe that leaves
+	//Score at or above checkerHealthyScore and halved after each one that leaves it below.
+	Backoff time.Duration
 }
 
 //NewChecker args:
@@ -42,6 +81,8 @@ func NewChecker(timeout int, interval int64, blockedFile, directFile string) Che
 		data:     NewConcurrentMap(),
 		interval: interval,
 		timeout:  timeout,
+		tokens:   make(chan struct{}, checkerRatePerSec),
+		jobs:     make(chan CheckerItem, checkerWorkers*2),
 	}
 	ch.blockedMap = ch.loadMap(blockedFile)
 	ch.directMap = ch.loadMap(directFile)
@@ -72,65 +113,152 @@ func (c *Checker) loadMap(f string) (dataMap ConcurrentMap) {
 	}
 	return
 }
+//start spins up the token-bucket filler, the bounded worker pool, and the
+//scheduler that feeds due hosts into the jobs queue.
 func (c *Checker) start() {
+	go c.fillTokens()
+	for i := 0; i < checkerWorkers; i++ {
+		go c.worker()
+	}
 	go func() {
 		for {
+			now := time.Now()
 			for _, v := range c.data.Items() {
-				go func(item CheckerItem) {
-					if c.isNeedCheck(item) {
-						//log.Printf("check %s", item.Domain)
-						var conn net.Conn
-						var err error
-						if item.IsHTTPS {
-							conn, err = ConnectHost(item.Host, c.timeout)
-							if err == nil {
-								conn.SetDeadline(time.Now().Add(time.Millisecond))
-								conn.Close()
-							}
-						} else {
-							err = HTTPGet(item.URL, c.timeout)
-						}
-						if err != nil {
-							item.FailCount = item.FailCount + 1
-						} else {
-							item.SuccessCount = item.SuccessCount + 1
-						}
-						c.data.Set(item.Host, item)
+				item := v.(CheckerItem)
+				if c.isNeedCheck(item, now) {
+					select {
+					case c.jobs <- item:
+					default:
+						//queue is full, this host will be picked up next tick
 					}
-				}(v.(CheckerItem))
+				}
 			}
 			time.Sleep(time.Second * time.Duration(c.interval))
 		}
 	}()
 }
-func (c *Checker) isNeedCheck(item CheckerItem) bool {
-	var minCount uint = 5
-	if (item.SuccessCount >= minCount && item.SuccessCount > item.FailCount) ||
-		(item.FailCount >= minCount && item.SuccessCount > item.FailCount) ||
-		c.domainIsInMap(item.Host, false) ||
-		c.domainIsInMap(item.Host, true) {
+
+//fillTokens issues a rate-limiting token checkerRatePerSec times a second,
+//dropping it if the bucket is already full.
+func (c *Checker) fillTokens() {
+	ticker := time.NewTicker(time.Second / checkerRatePerSec)
+	defer ticker.Stop()
+	for range ticker.C {
+		select {
+		case c.tokens <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//worker drains the jobs queue, waiting for a rate-limit token before each probe
+//so the pool never exceeds checkerWorkers concurrent checks or the configured rate.
+func (c *Checker) worker() {
+	for item := range c.jobs {
+		<-c.tokens
+		c.probe(item)
+	}
+}
+
+//probe checks a single host and folds the outcome into its EWMA score.
+func (c *Checker) probe(item CheckerItem) {
+	var err error
+	if item.IsHTTPS {
+		var conn net.Conn
+		conn, err = ConnectHost(item.Host, c.timeout)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(time.Millisecond))
+			conn.Close()
+		}
+	} else {
+		err = c.probeHTTPStream(item.URL)
+	}
+	c.record(item, err == nil)
+}
+
+//probeHTTPStream streams the response instead of buffering it fully, aborting the
+//connection as soon as checkerProbeBytes have been read so a huge or slow response
+//body can't inflate memory usage.
+func (c *Checker) probeHTTPStream(URL string) (err error) {
+	client := http.Client{Timeout: time.Duration(c.timeout) * time.Millisecond}
+	resp, err := client.Get(URL)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	_, err = io.CopyN(ioutil.Discard, resp.Body, checkerProbeBytes)
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+//record updates item's EWMA score and adaptive backoff from the outcome of a probe,
+//then stores it back. A run of successes grows the recheck interval, a run of
+//failures shrinks it.
+func (c *Checker) record(item CheckerItem, ok bool) {
+	outcome := 0.0
+	if ok {
+		outcome = 1.0
+	}
+	item.Score = item.Score*(1-checkerEWMAAlpha) + outcome*checkerEWMAAlpha
+	switch {
+	case item.Score >= checkerHealthyScore:
+		item.Backoff *= 2
+	default:
+		item.Backoff /= 2
+	}
+	if item.Backoff < checkerMinBackoff {
+		item.Backoff = checkerMinBackoff
+	}
+	if item.Backoff > checkerMaxBackoff {
+		item.Backoff = checkerMaxBackoff
+	}
+	item.NextCheck = time.Now().Add(item.Backoff)
+	c.data.Set(item.Host, item)
+}
+
+func (c *Checker) isNeedCheck(item CheckerItem, now time.Time) bool {
+	if c.domainIsInMap(item.Host, false) || c.domainIsInMap(item.Host, true) {
 		return false
 	}
-	return true
+	return now.After(item.NextCheck)
 }
-func (c *Checker) IsBlocked(address string) (blocked bool, failN, successN uint) {
+func (c *Checker) IsBlocked(address string) (blocked bool, score float64) {
 	if c.domainIsInMap(address, true) {
 		//log.Printf("%s in blocked ? true", address)
-		return true, 0, 0
+		return true, 0
 	}
 	if c.domainIsInMap(address, false) {
 		//log.Printf("%s in direct ? true", address)
-		return false, 0, 0
+		return false, 1
 	}
 
 	_item, ok := c.data.Get(address)
 	if !ok {
 		//log.Printf("%s not in map, blocked true", address)
-		return true, 0, 0
+		return true, 0
 	}
 	item := _item.(CheckerItem)
 
-	return item.FailCount >= item.SuccessCount, item.FailCount, item.SuccessCount
+	return item.Score < checkerHealthyScore, item.Score
+}
+
+//Stats returns the current EWMA score, next scheduled check time, and backoff
+//interval tracked for host. ok is false if host isn't tracked yet.
+func (c *Checker) Stats(host string) (stats CheckerStats, ok bool) {
+	var _item interface{}
+	_item, ok = c.data.Get(host)
+	if !ok {
+		return
+	}
+	item := _item.(CheckerItem)
+	stats = CheckerStats{
+		Score:     item.Score,
+		NextCheck: item.NextCheck,
+		Backoff:   item.Backoff,
+	}
+	return
 }
 func (c *Checker) domainIsInMap(address string, blockedMap bool) bool {
 	u, err := url.Parse("http://" + address)
@@ -175,105 +303,85 @@ func (c *Checker) Add(address string, isHTTPS bool, method, URL string, data []b
 	c.data.SetIfAbsent(item.Host, item)
 }
 
-type BasicAuth struct {
-	data ConcurrentMap
-}
-
-func NewBasicAuth() BasicAuth {
-	return BasicAuth{
-		data: NewConcurrentMap(),
-	}
-}
-func (ba *BasicAuth) AddFromFile(file string) (n int, err error) {
-	_content, err := ioutil.ReadFile(file)
-	if err != nil {
-		return
-	}
-	userpassArr := strings.Split(strings.Replace(string(_content), "\r", "", -1), "\n")
-	for _, userpass := range userpassArr {
-		if strings.HasPrefix("#", userpass) {
-			continue
-		}
-		u := strings.Split(strings.Trim(userpass, " "), ":")
-		if len(u) == 2 {
-			ba.data.Set(u[0], u[1])
-			n++
-		}
-	}
-	return
-}
-
-func (ba *BasicAuth) Add(userpassArr []string) (n int) {
-	for _, userpass := range userpassArr {
-		u := strings.Split(userpass, ":")
-		if len(u) == 2 {
-			ba.data.Set(u[0], u[1])
-			n++
-		}
-	}
-	return
-}
-func (ba *BasicAuth) CheckUserPass(user, pass string) (ok bool) {
-	if p, _ok := ba.data.Get(user); _ok {
-		return p.(string) == pass
-	}
-	return
-}
-func (ba *BasicAuth) Check(userpass string) (ok bool) {
-	u := strings.Split(strings.Trim(userpass, " "), ":")
-	if len(u) == 2 {
-		if p, _ok := ba.data.Get(u[0]); _ok {
-			return p.(string) == u[1]
-		}
-	}
-	return
-}
-func (ba *BasicAuth) Total() (n int) {
-	n = ba.data.Count()
-	return
-}
-
 type HTTPRequest struct {
 	HeadBuf     []byte
 	conn        *net.Conn
+	connReader  *HTTPConnReader
+	httpReq     *http.Request
 	Host        string
 	Method      string
 	URL         string
 	hostOrURL   string
 	isBasicAuth bool
-	basicAuth   *BasicAuth
+	auth        Auth
+}
+
+//HTTPConnReader is the persistent bufio.Reader (plus the raw bytes it has teed off
+//the connection but not yet handed out as a HeadBuf) backing repeated NewHTTPRequest
+//calls on the same net.Conn. A single bufio.Reader fill() can read past the end of
+//the current request and into the next pipelined/keep-alive one; keeping this reader
+//alive across calls — instead of building a fresh one per call — means those
+//over-read bytes stay buffered for the next request rather than being silently
+//discarded along with the throwaway reader.
+type HTTPConnReader struct {
+	br     *bufio.Reader
+	teeBuf *bytes.Buffer
+}
+
+//NewHTTPConnReader wraps inConn in a buffered, tee'd reader sized bufSize. Pass the
+//result back into NewHTTPRequest for every subsequent request decoded off inConn.
+func NewHTTPConnReader(inConn *net.Conn, bufSize int) *HTTPConnReader {
+	cr := &HTTPConnReader{teeBuf: &bytes.Buffer{}}
+	cr.br = bufio.NewReaderSize(io.TeeReader(*inConn, cr.teeBuf), bufSize)
+	return cr
 }
 
-func NewHTTPRequest(inConn *net.Conn, bufSize int, isBasicAuth bool, basicAuth *BasicAuth) (req HTTPRequest, err error) {
-	buf := make([]byte, bufSize)
-	len := 0
+//ConnReader returns the HTTPConnReader backing req, for passing into the next
+//NewHTTPRequest call on the same connection (keep-alive/pipelining).
+func (req *HTTPRequest) ConnReader() *HTTPConnReader {
+	return req.connReader
+}
+
+//NewHTTPRequest decodes an inbound HTTP or CONNECT request off inConn. It hands a
+//bufio.Reader to http.ReadRequest so method/URL/host/headers are parsed correctly
+//regardless of size or pipelining. cr may be nil on the first call for a connection;
+//pass req.ConnReader() back in on later calls so a pipelined request's bytes,
+//over-read into the buffer while decoding the previous one, aren't lost. The raw
+//bytes consumed by the parser for THIS request (request line and headers) are
+//preserved in HeadBuf, without bytes belonging to the next pipelined request.
+//HeadBuf does not include the request body; body bytes already read into cr's
+//buffer are not part of HeadBuf.
+func NewHTTPRequest(inConn *net.Conn, bufSize int, isBasicAuth bool, auth Auth, cr *HTTPConnReader) (req HTTPRequest, err error) {
+	if cr == nil {
+		cr = NewHTTPConnReader(inConn, bufSize)
+	}
 	req = HTTPRequest{
-		conn: inConn,
+		conn:       inConn,
+		connReader: cr,
 	}
-	len, err = (*inConn).Read(buf[:])
+	before := cr.teeBuf.Len() - cr.br.Buffered()
+	req.httpReq, err = http.ReadRequest(cr.br)
 	if err != nil {
-		if err != io.EOF {
-			err = fmt.Errorf("http decoder read err:%s", err)
-		}
+		err = fmt.Errorf("http decoder read err:%s", err)
 		CloseConn(inConn)
 		return
 	}
-	req.HeadBuf = buf[:len]
-	index := bytes.IndexByte(req.HeadBuf, '\n')
-	if index == -1 {
-		err = fmt.Errorf("http decoder data line err:%s", SubStr(string(req.HeadBuf), 0, 50))
-		CloseConn(inConn)
-		return
-	}
-	fmt.Sscanf(string(req.HeadBuf[:index]), "%s%s", &req.Method, &req.hostOrURL)
-	if req.Method == "" || req.hostOrURL == "" {
-		err = fmt.Errorf("http decoder data err:%s", SubStr(string(req.HeadBuf), 0, 50))
-		CloseConn(inConn)
-		return
+	after := cr.teeBuf.Len() - cr.br.Buffered()
+	req.HeadBuf = make([]byte, after-before)
+	copy(req.HeadBuf, cr.teeBuf.Bytes()[before:after])
+	//drop the bytes this request consumed now that they're copied into HeadBuf,
+	//keeping only the next request's leftover so teeBuf doesn't grow unbounded
+	//over a long-lived keep-alive connection.
+	cr.teeBuf.Next(after)
+	req.Method = strings.ToUpper(req.httpReq.Method)
+	req.Host = req.httpReq.Host
+	if req.IsHTTPS() {
+		req.hostOrURL = req.Host
+	} else {
+		req.hostOrURL = req.httpReq.RequestURI
 	}
-	req.Method = strings.ToUpper(req.Method)
 	req.isBasicAuth = isBasicAuth
-	req.basicAuth = basicAuth
+	req.auth = auth
 	log.Printf("%s:%s", req.Method, req.hostOrURL)
 
 	if req.IsHTTPS() {
@@ -314,30 +422,32 @@ func (req *HTTPRequest) IsHTTPS() bool {
 
 func (req *HTTPRequest) BasicAuth() (err error) {
 
-	//log.Printf("request :%s", string(b[:n]))
-	authorization, err := req.getHeader("Authorization")
+	//proxies authenticate against Proxy-Authorization, not Authorization, which is
+	//reserved for credentials aimed at the origin server
+	authorization, err := req.getHeader("Proxy-Authorization")
 	if err != nil {
-		fmt.Fprint((*req.conn), "HTTP/1.1 401 Unauthorized\r\nWWW-Authenticate: Basic realm=\"\"\r\n\r\nUnauthorized")
+		fmt.Fprint((*req.conn), "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"\"\r\n\r\nProxy Authentication Required")
 		CloseConn(req.conn)
 		return
 	}
-	//log.Printf("Authorization:%s", authorization)
+	//log.Printf("Proxy-Authorization:%s", authorization)
 	basic := strings.Fields(authorization)
 	if len(basic) != 2 {
 		err = fmt.Errorf("authorization data error,ERR:%s", authorization)
 		CloseConn(req.conn)
 		return
 	}
-	user, err := base64.StdEncoding.DecodeString(basic[1])
+	userpass, err := base64.StdEncoding.DecodeString(basic[1])
 	if err != nil {
 		err = fmt.Errorf("authorization data parse error,ERR:%s", err)
 		CloseConn(req.conn)
 		return
 	}
-	authOk := (*req.basicAuth).Check(string(user))
-	//log.Printf("auth %s,%v", string(user), authOk)
+	u := strings.SplitN(string(userpass), ":", 2)
+	authOk := len(u) == 2 && req.auth.Validate(u[0], u[1])
+	//log.Printf("auth %s,%v", u, authOk)
 	if !authOk {
-		fmt.Fprint((*req.conn), "HTTP/1.1 401 Unauthorized\r\n\r\nUnauthorized")
+		fmt.Fprint((*req.conn), "HTTP/1.1 407 Proxy Authentication Required\r\n\r\nProxy Authentication Required")
 		CloseConn(req.conn)
 		err = fmt.Errorf("basic auth fail")
 		return
@@ -345,31 +455,21 @@ func (req *HTTPRequest) BasicAuth() (err error) {
 	return
 }
 func (req *HTTPRequest) getHTTPURL() (URL string, err error) {
-	if !strings.HasPrefix(req.hostOrURL, "/") {
-		return req.hostOrURL, nil
+	if req.httpReq.URL.IsAbs() {
+		return req.httpReq.URL.String(), nil
 	}
-	_host, err := req.getHeader("host")
-	if err != nil {
+	if req.Host == "" {
+		err = fmt.Errorf("can not find HOST header")
 		return
 	}
-	URL = fmt.Sprintf("http://%s%s", _host, req.hostOrURL)
+	URL = fmt.Sprintf("http://%s%s", req.Host, req.httpReq.URL.RequestURI())
 	return
 }
 func (req *HTTPRequest) getHeader(key string) (val string, err error) {
-	key = strings.ToUpper(key)
-	lines := strings.Split(string(req.HeadBuf), "\r\n")
-	for _, line := range lines {
-		line := strings.SplitN(strings.Trim(line, "\r\n "), ":", 2)
-		if len(line) == 2 {
-			k := strings.ToUpper(strings.Trim(line[0], " "))
-			v := strings.Trim(line[1], " ")
-			if key == k {
-				val = v
-				return
-			}
-		}
+	val = req.httpReq.Header.Get(key)
+	if val == "" {
+		err = fmt.Errorf("can not find %s header", key)
 	}
-	err = fmt.Errorf("can not find HOST header")
 	return
 }
 
@@ -397,9 +497,49 @@ type OutPool struct {
 	kcpKey    string
 	address   string
 	timeout   int
+	tlsConfig *tls.Config
+}
+
+//ListCiphers returns the name of every cipher suite this Go build supports,
+//including the ones Go considers insecure (disabled unless explicitly requested
+//via CipherSuites), so operators can discover valid values for NewOutPool.
+func ListCiphers() (names []string) {
+	for _, c := range tls.CipherSuites() {
+		names = append(names, c.Name)
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		names = append(names, c.Name)
+	}
+	return
+}
+
+//cipherSuiteIDs maps cipher suite names, as returned by ListCiphers, to the IDs
+//tls.Config.CipherSuites expects.
+func cipherSuiteIDs(names []string) (ids []uint16, err error) {
+	byName := map[string]uint16{}
+	for _, c := range tls.CipherSuites() {
+		byName[c.Name] = c.ID
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		byName[c.Name] = c.ID
+	}
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			err = fmt.Errorf("unknown cipher suite:%s", name)
+			return
+		}
+		ids = append(ids, id)
+	}
+	return
 }
 
-func NewOutPool(dur int, typ, kcpMethod, kcpKey string, certBytes, keyBytes []byte, address string, timeout int, InitialCap int, MaxCap int) (op OutPool) {
+//NewOutPool args minVersion/maxVersion/cipherSuites/serverName/insecureSkipVerify
+//configure the *tls.Config used when typ is "tls" — cipherSuites names are mapped
+//via cipherSuiteIDs (see ListCiphers for valid values), letting operators pin a
+//minimum TLS version, restrict cipher suites, or interoperate with middleboxes
+//that need a specific ServerName or relaxed verification.
+func NewOutPool(dur int, typ, kcpMethod, kcpKey string, certBytes, keyBytes []byte, address string, timeout int, InitialCap int, MaxCap int, minVersion, maxVersion uint16, cipherSuites []string, serverName string, insecureSkipVerify bool) (op OutPool) {
 	op = OutPool{
 		dur:       dur,
 		typ:       typ,
@@ -410,6 +550,21 @@ func NewOutPool(dur int, typ, kcpMethod, kcpKey string, certBytes, keyBytes []by
 		address:   address,
 		timeout:   timeout,
 	}
+	if typ == "tls" {
+		op.tlsConfig = &tls.Config{
+			MinVersion:         minVersion,
+			MaxVersion:         maxVersion,
+			ServerName:         serverName,
+			InsecureSkipVerify: insecureSkipVerify,
+		}
+		if len(cipherSuites) > 0 {
+			ids, err := cipherSuiteIDs(cipherSuites)
+			if err != nil {
+				log.Fatalf("init tls config fail ,%s", err)
+			}
+			op.tlsConfig.CipherSuites = ids
+		}
+	}
 	var err error
 	op.Pool, err = NewConnPool(poolConfig{
 		IsActive: func(conn interface{}) bool { return true },
@@ -439,12 +594,44 @@ func NewOutPool(dur int, typ, kcpMethod, kcpKey string, certBytes, keyBytes []by
 	}
 	return
 }
+//TlsConnectHost dials address with a plain TCP connection and wraps it in a TLS
+//client using tlsConfig (falling back to an InsecureSkipVerify config if nil),
+//loading certBytes/keyBytes as a client certificate when both are present. tlsConfig
+//is cloned before use since callers such as OutPool share one *tls.Config across
+//many concurrent dials.
+func TlsConnectHost(address string, timeout int, certBytes, keyBytes []byte, tlsConfig *tls.Config) (conn *tls.Conn, err error) {
+	rawConn, err := net.DialTimeout("tcp", address, time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		return
+	}
+	conf := tlsConfig.Clone()
+	if conf == nil {
+		conf = &tls.Config{InsecureSkipVerify: true}
+	}
+	if len(certBytes) > 0 && len(keyBytes) > 0 {
+		var cert tls.Certificate
+		cert, err = tls.X509KeyPair(certBytes, keyBytes)
+		if err != nil {
+			rawConn.Close()
+			return
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	tlsConn := tls.Client(rawConn, conf)
+	if err = tlsConn.Handshake(); err != nil {
+		rawConn.Close()
+		return
+	}
+	conn = tlsConn
+	return
+}
+
 func (op *OutPool) getConn() (conn interface{}, err error) {
 	if op.typ == "tls" {
-		var _conn tls.Conn
-		_conn, err = TlsConnectHost(op.address, op.timeout, op.certBytes, op.keyBytes)
+		var _conn *tls.Conn
+		_conn, err = TlsConnectHost(op.address, op.timeout, op.certBytes, op.keyBytes, op.tlsConfig)
 		if err == nil {
-			conn = net.Conn(&_conn)
+			conn = net.Conn(_conn)
 		}
 	} else if op.typ == "kcp" {
 		conn, err = ConnectKCPHost(op.address, op.kcpMethod, op.kcpKey)
@@ -474,100 +661,161 @@ func (op *OutPool) initPoolDeamon() {
 	}()
 }
 
+//FrameType identifies the kind of payload carried by a HeartbeatReadWriter frame.
+type FrameType uint8
+
+const (
+	FrameHeartbeat FrameType = iota
+	FrameData
+	FramePing
+	FramePong
+	FrameClose
+	FrameError
+)
+
+//frameHeaderLen is the fixed 1-byte type + 4-byte length-prefix every frame starts with.
+const frameHeaderLen = 5
+
 type HeartbeatData struct {
 	Data  []byte
 	N     int
 	Error error
 }
 type HeartbeatReadWriter struct {
-	conn *net.Conn
-	// rchn       chan HeartbeatData
+	conn       *net.Conn
 	l          *sync.Mutex
 	dur        int
 	errHandler func(err error, hb *HeartbeatReadWriter)
 	once       *sync.Once
-	datachn    chan byte
-	// rbuf       bytes.Buffer
-	// signal     chan bool
-	rerrchn chan error
+
+	rbuf  bytes.Buffer
+	rl    *sync.Mutex
+	rcond *sync.Cond
+	rerr  error
+
+	pingL    *sync.Mutex
+	pingSent time.Time
+	rttChn   chan time.Duration
+
+	//readScratch/writeScratch are reused per-connection header buffers so reading or
+	//writing a frame header allocates nothing; readFrame still allocates a new slice
+	//for each non-empty payload.
+	readScratch  [frameHeaderLen]byte
+	writeScratch [frameHeaderLen]byte
 }
 
 func NewHeartbeatReadWriter(conn *net.Conn, dur int, fn func(err error, hb *HeartbeatReadWriter)) (hrw HeartbeatReadWriter) {
 	hrw = HeartbeatReadWriter{
-		conn: conn,
-		l:    &sync.Mutex{},
-		dur:  dur,
-		// rchn:       make(chan HeartbeatData, 10000),
-		// signal:     make(chan bool, 1),
+		conn:       conn,
+		l:          &sync.Mutex{},
+		dur:        dur,
 		errHandler: fn,
-		datachn:    make(chan byte, 4*1024),
 		once:       &sync.Once{},
-		rerrchn:    make(chan error, 1),
-		// rbuf:       bytes.Buffer{},
+		rl:         &sync.Mutex{},
+		pingL:      &sync.Mutex{},
+		rttChn:     make(chan time.Duration, 1),
 	}
+	hrw.rcond = sync.NewCond(hrw.rl)
 	hrw.heartbeat()
 	hrw.reader()
 	return
 }
 
-func (rw *HeartbeatReadWriter) Close() {
+//Close sends a best-effort Close frame carrying reason and closes the underlying conn.
+func (rw *HeartbeatReadWriter) Close(reason string) {
+	rw.writeFrame(FrameClose, []byte(reason))
 	CloseConn(rw.conn)
 }
+
+//SendError sends an Error frame carrying msg, letting the remote side's reader()
+//surface it as the terminal error for its own Read/errHandler, the mirror of how a
+//Close frame we receive is surfaced on this side.
+func (rw *HeartbeatReadWriter) SendError(msg string) error {
+	return rw.writeFrame(FrameError, []byte(msg))
+}
+
 func (rw *HeartbeatReadWriter) reader() {
 	go func() {
 		//log.Printf("heartbeat read started")
 		for {
-			n, data, err := rw.read()
-			if n == -1 {
-				continue
-			}
-			//log.Printf("n:%d , data:%s ,err:%s", n, string(data), err)
-			if err == nil {
-				//fmt.Printf("write data %s\n", string(data))
-				for _, b := range data {
-					rw.datachn <- b
-				}
-			}
+			typ, payload, err := rw.readFrame()
 			if err != nil {
 				//log.Printf("heartbeat reader err: %s", err)
+				rw.fail(err)
+				return
+			}
+			switch typ {
+			case FrameData:
+				rw.rl.Lock()
+				rw.rbuf.Write(payload)
+				rw.rcond.Broadcast()
+				rw.rl.Unlock()
+			case FramePing:
+				rw.writeFrame(FramePong, nil)
+			case FramePong:
+				rw.pingL.Lock()
+				rtt := time.Since(rw.pingSent)
+				rw.pingL.Unlock()
 				select {
-				case rw.rerrchn <- err:
+				case rw.rttChn <- rtt:
 				default:
 				}
-				rw.once.Do(func() {
-					rw.errHandler(err, rw)
-				})
-				break
+			case FrameClose:
+				rw.fail(fmt.Errorf("remote closed connection: %s", string(payload)))
+				return
+			case FrameError:
+				rw.fail(fmt.Errorf("remote reported error: %s", string(payload)))
+				return
+			case FrameHeartbeat:
+				// liveness only, nothing to deliver
 			}
 		}
 		//log.Printf("heartbeat read exited")
 	}()
 }
-func (rw *HeartbeatReadWriter) read() (n int, data []byte, err error) {
-	var typ uint8
-	err = binary.Read((*rw.conn), binary.LittleEndian, &typ)
+
+//fail records err as the terminal read error, wakes any blocked Read, and runs
+//errHandler exactly once.
+func (rw *HeartbeatReadWriter) fail(err error) {
+	rw.rl.Lock()
+	rw.rerr = err
+	rw.rcond.Broadcast()
+	rw.rl.Unlock()
+	rw.once.Do(func() {
+		rw.errHandler(err, rw)
+	})
+}
+
+//readFrame reads one frame's header with io.ReadFull (never a short read) and then
+//its payload, if any.
+func (rw *HeartbeatReadWriter) readFrame() (typ FrameType, payload []byte, err error) {
+	_, err = io.ReadFull((*rw.conn), rw.readScratch[:])
 	if err != nil {
 		return
 	}
-	if typ == 0 {
-		// log.Printf("heartbeat revecived")
-		n = -1
+	typ = FrameType(rw.readScratch[0])
+	length := binary.LittleEndian.Uint32(rw.readScratch[1:])
+	if length == 0 {
 		return
 	}
-	var dataLength uint32
-	binary.Read((*rw.conn), binary.LittleEndian, &dataLength)
-	_data := make([]byte, dataLength)
-	// log.Printf("dataLength:%d , data:%s", dataLength, string(data))
-	n, err = (*rw.conn).Read(_data)
-	//log.Printf("n:%d , data:%s ,err:%s", n, string(data), err)
-	if err != nil {
+	payload = make([]byte, length)
+	_, err = io.ReadFull((*rw.conn), payload)
+	return
+}
+
+//writeFrame writes a header (type + length) followed by payload as a single logical
+//frame, serialized by l so concurrent Writes/heartbeats/pings can't interleave.
+func (rw *HeartbeatReadWriter) writeFrame(typ FrameType, payload []byte) (err error) {
+	rw.l.Lock()
+	defer rw.l.Unlock()
+	rw.writeScratch[0] = byte(typ)
+	binary.LittleEndian.PutUint32(rw.writeScratch[1:], uint32(len(payload)))
+	if _, err = (*rw.conn).Write(rw.writeScratch[:]); err != nil {
 		return
 	}
-	if uint32(n) != dataLength {
-		err = fmt.Errorf("read short data body")
-		return
+	if len(payload) > 0 {
+		_, err = (*rw.conn).Write(payload)
 	}
-	data = _data[:n]
 	return
 }
 func (rw *HeartbeatReadWriter) heartbeat() {
@@ -578,46 +826,50 @@ func (rw *HeartbeatReadWriter) heartbeat() {
 				//log.Printf("heartbeat err: conn nil")
 				break
 			}
-			rw.l.Lock()
-			_, err := (*rw.conn).Write([]byte{0})
-			rw.l.Unlock()
+			err := rw.writeFrame(FrameHeartbeat, nil)
 			if err != nil {
 				//log.Printf("heartbeat err: %s", err)
-				rw.once.Do(func() {
-					rw.errHandler(err, rw)
-				})
+				rw.fail(err)
 				break
-			} else {
-				// log.Printf("heartbeat send ok")
 			}
+			// log.Printf("heartbeat send ok")
 			time.Sleep(time.Second * time.Duration(rw.dur))
 		}
 		//log.Printf("heartbeat exited")
 	}()
 }
+
+//Ping sends a Ping frame and blocks until the matching Pong is observed by reader()
+//or timeout elapses, returning the measured round-trip time.
+func (rw *HeartbeatReadWriter) Ping(timeout time.Duration) (rtt time.Duration, err error) {
+	rw.pingL.Lock()
+	rw.pingSent = time.Now()
+	rw.pingL.Unlock()
+	if err = rw.writeFrame(FramePing, nil); err != nil {
+		return
+	}
+	select {
+	case rtt = <-rw.rttChn:
+	case <-time.After(timeout):
+		err = fmt.Errorf("ping timeout")
+	}
+	return
+}
 func (rw *HeartbeatReadWriter) Read(p []byte) (n int, err error) {
-	data := make([]byte, cap(p))
-	for i := 0; i < cap(p); i++ {
-		data[i] = <-rw.datachn
-		n++
-		//fmt.Printf("read  %d %v\n", i, data[:n])
-		if len(rw.datachn) == 0 {
-			n = i + 1
-			copy(p, data[:n])
-			return
-		}
+	rw.rl.Lock()
+	defer rw.rl.Unlock()
+	for rw.rbuf.Len() == 0 && rw.rerr == nil {
+		rw.rcond.Wait()
 	}
+	if rw.rbuf.Len() > 0 {
+		n, _ = rw.rbuf.Read(p)
+		return
+	}
+	err = rw.rerr
 	return
 }
 func (rw *HeartbeatReadWriter) Write(p []byte) (n int, err error) {
-	defer rw.l.Unlock()
-	rw.l.Lock()
-	pkg := new(bytes.Buffer)
-	binary.Write(pkg, binary.LittleEndian, uint8(1))
-	binary.Write(pkg, binary.LittleEndian, uint32(len(p)))
-	binary.Write(pkg, binary.LittleEndian, p)
-	bs := pkg.Bytes()
-	n, err = (*rw.conn).Write(bs)
+	err = rw.writeFrame(FrameData, p)
 	if err == nil {
 		n = len(p)
 	}
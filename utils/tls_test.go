@@ -0,0 +1,21 @@
+package utils
+
+import "testing"
+
+func TestCipherSuiteIDs(t *testing.T) {
+	names := ListCiphers()
+	if len(names) == 0 {
+		t.Fatal("ListCiphers() returned no suites")
+	}
+	ids, err := cipherSuiteIDs(names[:1])
+	if err != nil {
+		t.Fatalf("cipherSuiteIDs(%v) err = %v", names[:1], err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("cipherSuiteIDs() = %v, want 1 id", ids)
+	}
+
+	if _, err := cipherSuiteIDs([]string{"NOT_A_REAL_CIPHER"}); err == nil {
+		t.Error("cipherSuiteIDs() with an unknown name should return an error")
+	}
+}